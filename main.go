@@ -36,14 +36,29 @@ package main
 //
 //  2. It is capable of reformatting whole programs, fragments of top-level
 //  identifiers, and excerpted segments of function blocks. package main
+//
+//  3. With -md, it reads a whole Markdown document on stdin and reformats
+//  every fenced Go code block in place, leaving the rest of the document
+//  untouched. This is handy for running over a README as a pre-commit hook
+//  instead of reformatting each fence by hand.
+//
+//  4. -s and -r mirror cmd/gofmt's flags of the same name: -s simplifies
+//  the code the same way gofmt -s does, and -r applies a single
+//  'pattern -> replacement' rewrite rule. This lets fenced examples in docs
+//  be normalized to the same canonical form CI enforces on the surrounding
+//  repo.
 
 import (
 	"bufio"
 	"bytes"
 	"errors"
+	"flag"
 	"fmt"
+	"go/ast"
+	"go/format"
+	"go/printer"
+	"go/token"
 	"io"
-	"iter"
 	"log"
 	"os"
 	"strings"
@@ -53,12 +68,25 @@ import (
 	// operating on fragments of programs instead of whole bodies of code.
 	"github.com/dave/dst"
 	"github.com/dave/dst/decorator"
+	"golang.org/x/mod/modfile"
 )
 
-func minIndent(in string) (n int) {
+// indent describes how a chunk of text is indented: the whitespace rune it
+// uses, and how many of them prefix its least-indented non-blank line.
+type indent struct {
+	char  rune
+	count int
+}
+
+// minIndent reports the indentation shared by every non-blank line of in,
+// along with the whitespace rune used by the first non-blank line. Nested
+// list items and blockquotes inside Markdown, and nested Go doc comments,
+// commonly indent with tabs rather than spaces, so the rune is not assumed.
+func minIndent(in string) indent {
 	r := strings.NewReader(in)
 	scanner := bufio.NewScanner(r)
-	n = -1
+	n := -1
+	var ch rune
 	for scanner.Scan() {
 		txt := scanner.Text()
 		if txt == "" {
@@ -69,22 +97,25 @@ func minIndent(in string) (n int) {
 			if !unicode.IsSpace(c) {
 				break
 			}
+			if i == 0 && n == -1 {
+				ch = c
+			}
 			i++
 		}
 		if n == -1 {
 			n = i
 		}
 		if i == 0 {
-			return 0 // No point in scanning further.
+			return indent{char: ' ', count: 0} // No point in scanning further.
 		}
 		if i < n {
 			n = i
 		}
 	}
 	if n < 0 {
-		return 0 // As a failsafe for empty lines.
+		return indent{char: ' ', count: 0} // As a failsafe for empty lines.
 	}
-	return n
+	return indent{char: ch, count: n}
 }
 
 func toAST(in string) (*dst.File, error) {
@@ -103,113 +134,247 @@ func toAST(in string) (*dst.File, error) {
 	return f, nil
 }
 
-var errGaveUp = errors.New("could not build AST")
+// sourceAdjuster trims the wrapping that a parse*-family function added
+// around a fragment so that only the caller's original text remains in the
+// formatted output. The wrapped AST is always printed at depth zero, so the
+// wrapper's own text is a known constant; this mirrors the sourceAdj approach
+// in cmd/gofmt's internal.go (see golang.org/issue/5551 and golang.org/issue/4449):
+// format the wrapped AST, then slice the wrapper back out by byte offset
+// instead of grepping for sentinel markers. An adjuster verifies the expected
+// wrapper text is actually where it expects to slice rather than trusting a
+// byte count blindly, since go/printer's exact output is not part of its
+// API contract.
+type sourceAdjuster func(out []byte) ([]byte, error)
+
+// fragment is whatever parse managed to make of a chunk of fenced content; it
+// knows how to render itself back out as formatted text.
+type fragment interface {
+	// format renders the fragment given the original source it was parsed
+	// from, which is needed to recover whitespace around fragments that had
+	// to be wrapped in order to parse.
+	format(prg string) (string, error)
+}
 
-func parseAsWholeProgram(prg string, buf *bytes.Buffer) (*dst.File, error) {
-	defer buf.Reset()
-	fmt.Fprintln(buf, "// BEGIN")
-	buf.WriteString(prg)
-	fmt.Fprintln(buf, "// END")
-	f, err := toAST(buf.String())
+func parseAsWholeProgram(prg string) (*dst.File, error) {
+	return toAST(prg)
+}
+
+func parseAsTopLevelIdentifiers(prg string) (*dst.File, sourceAdjuster, int, error) {
+	// Insert using a ';', not a newline, so that dst's own line numbers
+	// stay aligned with prg; the printer turns the ';' back into '\n'.
+	f, err := toAST("package p;" + prg)
 	if err != nil {
-		return nil, err
+		return nil, nil, 0, err
 	}
-	return f, nil
+	adj := func(out []byte) ([]byte, error) {
+		const prefix = "package p\n"
+		if !bytes.HasPrefix(out, []byte(prefix)) {
+			return nil, fmt.Errorf("formatted output %q lacks expected prefix %q", out, prefix)
+		}
+		return bytes.TrimSpace(out[len(prefix):]), nil
+	}
+	return f, adj, 0, nil
 }
 
-func parseAsTopLevelIdentifiers(prg string, buf *bytes.Buffer) (*dst.File, error) {
-	defer buf.Reset()
-	fmt.Fprintln(buf, "package main")
-	fmt.Fprintln(buf, "")
-	fmt.Fprintln(buf, "// BEGIN")
-	buf.WriteString(prg)
-	fmt.Fprintln(buf, "// END")
-	f, err := toAST(buf.String())
+func parseAsFunction(prg string) (*dst.File, sourceAdjuster, int, error) {
+	// As above, but also wrap in a function so that statement lists (not
+	// just declarations) are accepted. An extra blank line precedes the
+	// closing brace so that trailing comments get flushed before it.
+	f, err := toAST("package p; func _() {" + prg + "\n\n}")
 	if err != nil {
-		return nil, err
+		return nil, nil, 0, err
 	}
-	return f, nil
+	adj := func(out []byte) ([]byte, error) {
+		// The printer turns the "; " into a "\n\n", separating the package
+		// clause and the func declaration onto their own lines.
+		const prefix, suffix = "package p\n\nfunc _() {", "}\n"
+		if !bytes.HasPrefix(out, []byte(prefix)) {
+			return nil, fmt.Errorf("formatted output %q lacks expected prefix %q", out, prefix)
+		}
+		if !bytes.HasSuffix(out, []byte(suffix)) {
+			return nil, fmt.Errorf("formatted output %q lacks expected suffix %q", out, suffix)
+		}
+		out = out[len(prefix) : len(out)-len(suffix)]
+		return bytes.TrimSpace(out), nil
+	}
+	// The printer indented the function body one level deeper than the
+	// fragment actually lives at (it's inside a block), so format dedents
+	// by one level afterward.
+	return f, adj, -1, nil
 }
 
-func parseAsFunction(prg string, buf *bytes.Buffer) (*dst.File, error) {
-	defer buf.Reset()
-	fmt.Fprintln(buf, "package main")
-	fmt.Fprintln(buf, "")
-	fmt.Fprintln(buf, "func init() {") // Just an arbitrary function to place things in.
-	fmt.Fprintln(buf, "// BEGIN")
-	buf.WriteString(prg)
-	fmt.Fprintln(buf, "// END")
-	fmt.Fprintln(buf, "}")
-	f, err := toAST(buf.String())
-	if err != nil {
-		return nil, err
+// looksLikeGoMod reports whether prg's first non-blank line reads like the
+// start of a go.mod file, i.e. a module or go directive.
+func looksLikeGoMod(prg string) bool {
+	for _, line := range strings.Split(prg, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		return strings.HasPrefix(line, "module ") || strings.HasPrefix(line, "go ")
 	}
-	return f, nil
+	return false
 }
 
+func parseAsGoMod(prg string) (*modfile.File, error) {
+	return modfile.Parse("go.mod", []byte(prg), nil)
+}
+
+var errGaveUp = errors.New("could not build AST")
+
 // parse attempts to generate an AST from the provided source in the reader.
 // It re-represents the source in various forms in case it cannot be converted
-// into an AST readily.  It returns the AST, the degree to which the Markdown
-// fence content is indented, and whether the AST representation further
-// indents the content unintentionally.
-func parse(r io.Reader) (ast *dst.File, mdIndent int, astIndent int, err error) {
+// into an AST readily.  It returns the fragment that knows how to render
+// itself, the degree to which the Markdown fence content is indented, the
+// original source text, and any error.
+func parse(r io.Reader) (frag fragment, mdIndent indent, prg string, err error) {
 	in, err := io.ReadAll(r)
 	if err != nil {
-		return nil, 0, 0, fmt.Errorf("reading: %v", err)
+		return nil, indent{}, "", fmt.Errorf("reading: %v", err)
 	}
-	prg := string(in)
-	astIndent = minIndent(prg)
-	var buf bytes.Buffer
-	if f, err := parseAsWholeProgram(prg, &buf); err == nil {
-		return f, astIndent, 0, nil
+	prg = string(in)
+	mdIndent = minIndent(prg)
+	if looksLikeGoMod(prg) {
+		if f, err := parseAsGoMod(prg); err == nil {
+			return modFragment{file: f}, mdIndent, prg, nil
+		}
 	}
-	if f, err := parseAsTopLevelIdentifiers(prg, &buf); err == nil {
-		return f, astIndent, 0, nil
+	if f, err := parseAsWholeProgram(prg); err == nil {
+		return dstFragment{file: f}, mdIndent, prg, nil
 	}
-	if f, err := parseAsFunction(prg, &buf); err == nil {
-		return f, astIndent, 1, nil
+	if f, adj, indentAdj, err := parseAsTopLevelIdentifiers(prg); err == nil {
+		return dstFragment{file: f, adj: adj, indentAdj: indentAdj}, mdIndent, prg, nil
 	}
-	return nil, 0, 0, errGaveUp
+	if f, adj, indentAdj, err := parseAsFunction(prg); err == nil {
+		return dstFragment{file: f, adj: adj, indentAdj: indentAdj}, mdIndent, prg, nil
+	}
+	return nil, indent{}, "", errGaveUp
 }
 
-func trimTrailingSpace(buf *bytes.Buffer) {
-	n := len(bytes.TrimRightFunc(buf.Bytes(), unicode.IsSpace))
-	buf.Truncate(n)
+// normalizeNumbers mirrors the unexported printer.Mode bit of the same name
+// that go/format and cmd/gofmt build with to canonicalize number literal
+// prefixes and exponents (see golang.org/doc/go1.13#gofmt).  go/printer does
+// not export it, so cmd/gofmt keeps its own copy of the bit value rather than
+// depend on it reflectively; we do the same here.
+const normalizeNumbers printer.Mode = 1 << 30
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r'
 }
 
-var errNoBeginning = errors.New("could not find beginning")
+// dstFragment is a fragment recognized as Go source via dave/dst. adj and
+// indentAdj are nil/0 when file is already a complete program; otherwise
+// they describe how to undo the wrapping that made it parseable.
+type dstFragment struct {
+	file      *dst.File
+	adj       sourceAdjuster
+	indentAdj int
+}
 
-func seekToBeginning(s *bufio.Scanner) error {
-	for s.Scan() {
-		line := strings.TrimSpace(s.Text())
-		if line == "// BEGIN" {
-			return s.Err()
-		}
+// dedent removes up to n leading tab bytes from every line of b. It is used
+// to undo the one level of block nesting that wrapping a fragment in
+// "func _() {...}" adds relative to the fragment's own statements.
+func dedent(b []byte, n int) []byte {
+	if n <= 0 {
+		return b
+	}
+	prefix := bytes.Repeat([]byte{'\t'}, n)
+	lines := bytes.Split(b, []byte("\n"))
+	for i, line := range lines {
+		lines[i] = bytes.TrimPrefix(line, prefix)
 	}
-	return errNoBeginning
+	return bytes.Join(lines, []byte("\n"))
 }
 
-var errNoEnd = errors.New("could not find end")
-
-func readLinesUntilEnd(s *bufio.Scanner) iter.Seq2[string, error] {
-	return func(yield func(string, error) bool) {
-		for s.Scan() {
-			line := s.Text()
-			switch {
-			case strings.TrimSpace(line) == "// END":
-				yield("", s.Err())
-				return
-			case strings.HasSuffix(line, "// END"):
-				yield(strings.TrimSuffix(line, "// END"), s.Err())
-				return
-			default:
-				if !yield(line, nil) {
-					return
-				}
-			}
+// format renders f.file and, for fragments (f.adj != nil), reconstitutes the
+// caller's original leading/trailing whitespace around the formatted body.
+// The fragment itself is always formatted at depth zero and with whatever
+// relative nesting f.indentAdj calls for undone by dedent; reindenting the
+// result to the depth the fence actually appeared at is run's job, via
+// mdIndent. Doing both here and in run double-applies the indentation.
+func (f dstFragment) format(prg string) (string, error) {
+	fset, af, err := decorator.RestoreFile(f.file)
+	if err != nil {
+		return "", fmt.Errorf("restoring AST: %v", err)
+	}
+	if rewrite != nil {
+		// rewriteFile operates on the *ast.File regardless of whether it's a
+		// whole program or the wrapped "package p; func _(){...}" AST behind
+		// a fragment, the same way simplify below does.
+		af = rewrite(fset, af)
+	}
+	if *simplifyAST {
+		simplify(af)
+	}
+	if f.adj == nil {
+		var buf bytes.Buffer
+		if err := format.Node(&buf, fset, af); err != nil {
+			return "", fmt.Errorf("formatting AST: %v", err)
+		}
+		return buf.String(), nil
+	}
+
+	src := []byte(prg)
+
+	// Determine and prepend leading space.
+	i, j := 0, 0
+	for j < len(src) && isSpace(src[j]) {
+		if src[j] == '\n' {
+			i = j + 1
 		}
-		yield("", errNoEnd)
+		j++
+	}
+	var res []byte
+	res = append(res, src[:i]...)
+
+	cfg := printer.Config{
+		Mode:     printer.UseSpaces | printer.TabIndent | normalizeNumbers,
+		Tabwidth: 8,
+	}
+	var buf bytes.Buffer
+	if err := cfg.Fprint(&buf, fset, af); err != nil {
+		return "", fmt.Errorf("formatting AST: %v", err)
+	}
+	out, err := f.adj(buf.Bytes())
+	if err != nil {
+		return "", fmt.Errorf("reconstituting fragment: %v", err)
+	}
+	if f.indentAdj < 0 {
+		out = dedent(out, -f.indentAdj)
+	}
+	if len(out) == 0 {
+		// The fragment was empty but (possibly) for white space.
+		return prg, nil
+	}
+	res = append(res, out...)
+
+	// Determine and append trailing space.
+	i = len(src)
+	for i > 0 && isSpace(src[i-1]) {
+		i--
+	}
+	return string(append(res, src[i:]...)), nil
+}
+
+// modFragment is a fragment recognized as a go.mod file via x/mod/modfile.
+// go.mod fences are always whole files, so no wrapping or un-wrapping is
+// needed the way it is for Go source fragments.
+type modFragment struct {
+	file *modfile.File
+}
+
+func (f modFragment) format(string) (string, error) {
+	f.file.Cleanup()
+	out, err := f.file.Format()
+	if err != nil {
+		return "", fmt.Errorf("formatting go.mod AST: %v", err)
 	}
+	return string(out), nil
+}
+
+func trimTrailingSpace(buf *bytes.Buffer) {
+	n := len(bytes.TrimRightFunc(buf.Bytes(), unicode.IsSpace))
+	buf.Truncate(n)
 }
 
 func isExclusivelyWhitespace(s string) bool {
@@ -222,34 +387,31 @@ func isExclusivelyWhitespace(s string) bool {
 }
 
 func run(r io.Reader, w io.Writer) error {
-	f, c, n, err := parse(r)
+	frag, mdIndent, prg, err := parse(r)
 	if err != nil {
 		return fmt.Errorf("parsing input: %v", err)
 	}
-	var formatted bytes.Buffer
-	if err := decorator.Fprint(&formatted, f); err != nil {
-		return fmt.Errorf("formatting AST: %v", err)
-	}
-	scanner := bufio.NewScanner(&formatted)
-	if err := seekToBeginning(scanner); err != nil {
-		return fmt.Errorf("seeking to beginning: %v", err)
+	out, err := frag.format(prg)
+	if err != nil {
+		return err
 	}
-	indent := strings.Repeat(" ", c)
+	prefix := strings.Repeat(string(mdIndent.char), mdIndent.count)
 	var buf bytes.Buffer
-	for line, err := range readLinesUntilEnd(scanner) {
-		if err != nil {
-			return fmt.Errorf("reading until end: %v", err)
-		}
-		switch {
-		case isExclusivelyWhitespace(line):
-			if _, err := fmt.Fprintf(&buf, "%s\n", indent); err != nil {
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || isExclusivelyWhitespace(line) {
+			if _, err := fmt.Fprintf(&buf, "%s\n", prefix); err != nil {
 				return fmt.Errorf("writing empty line: %v", err)
 			}
-		default:
-			if _, err := fmt.Fprintf(&buf, "%s%s\n", indent, line[n:]); err != nil {
-				return fmt.Errorf("writing line: %v", err)
-			}
+			continue
 		}
+		if _, err := fmt.Fprintf(&buf, "%s%s\n", prefix, line); err != nil {
+			return fmt.Errorf("writing line: %v", err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reindenting output: %v", err)
 	}
 	trimTrailingSpace(&buf)
 	if _, err := io.Copy(w, &buf); err != nil {
@@ -258,8 +420,162 @@ func run(r io.Reader, w io.Writer) error {
 	return nil
 }
 
+// goFence describes a Markdown fenced code block's opening delimiter: the
+// whitespace it's indented by (to support fences nested in list items or
+// blockquotes), which rune it's built from, how many of that rune were used
+// to open it, and its info string.
+type goFence struct {
+	indent string
+	char   byte
+	count  int
+	info   string
+}
+
+// parseFenceOpen reports whether line opens a Markdown fenced code block
+// (``` or ~~~, three or more of either character), along with its indent,
+// delimiter, and info string.
+func parseFenceOpen(line string) (goFence, bool) {
+	trimmed := strings.TrimLeft(line, " \t")
+	indent := line[:len(line)-len(trimmed)]
+	if trimmed == "" {
+		return goFence{}, false
+	}
+	ch := trimmed[0]
+	if ch != '`' && ch != '~' {
+		return goFence{}, false
+	}
+	n := 0
+	for n < len(trimmed) && trimmed[n] == ch {
+		n++
+	}
+	if n < 3 {
+		return goFence{}, false
+	}
+	info := strings.TrimSpace(trimmed[n:])
+	if ch == '`' && strings.ContainsRune(info, '`') {
+		return goFence{}, false // A backtick fence's info string can't contain a backtick.
+	}
+	return goFence{indent: indent, char: ch, count: n, info: info}, true
+}
+
+// isFenceClose reports whether line closes the fence f: the same character
+// repeated at least f.count times and nothing else besides whitespace.
+func isFenceClose(line string, f goFence) bool {
+	trimmed := strings.TrimLeft(line, " \t")
+	n := 0
+	for n < len(trimmed) && trimmed[n] == f.char {
+		n++
+	}
+	if n < f.count {
+		return false
+	}
+	return strings.TrimSpace(trimmed[n:]) == ""
+}
+
+// isGoFence reports whether a fence with the given info string should be
+// handed to run: Go source (an empty info string is accepted too, since
+// gofencefmt is squarely aimed at Go-centric documents and most untagged
+// fences encountered in the wild turn out to be Go) or a go.mod file, which
+// parse recognizes on its own via looksLikeGoMod.
+func isGoFence(info string) bool {
+	if info == "" {
+		return true
+	}
+	lang := strings.Fields(info)[0]
+	return strings.EqualFold(lang, "go") || strings.EqualFold(lang, "go.mod")
+}
+
+// runMarkdown reads a whole Markdown document from r and writes it back to
+// w with every fenced Go code block reformatted in place via run; fences
+// tagged with another language, or left unterminated, are copied through
+// verbatim. A fenced Go block that fails to parse is left untouched and
+// reported to stderr rather than aborting the whole document.
+func runMarkdown(r io.Reader, w io.Writer) error {
+	in, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("reading: %v", err)
+	}
+	trailingNewline := strings.HasSuffix(string(in), "\n")
+	lines := strings.Split(strings.TrimSuffix(string(in), "\n"), "\n")
+
+	var out []string
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		open, ok := parseFenceOpen(line)
+		if !ok {
+			out = append(out, line)
+			continue
+		}
+		end := -1
+		for j := i + 1; j < len(lines); j++ {
+			if isFenceClose(lines[j], open) {
+				end = j
+				break
+			}
+		}
+		if end == -1 || !isGoFence(open.info) {
+			out = append(out, line)
+			continue
+		}
+		body := strings.Join(lines[i+1:end], "\n")
+		if body != "" {
+			body += "\n"
+		}
+		var formatted bytes.Buffer
+		if err := run(strings.NewReader(body), &formatted); err != nil {
+			fmt.Fprintf(os.Stderr, "gofencefmt: leaving fence at line %d untouched: %v\n", i+1, err)
+			out = append(out, lines[i:end+1]...)
+			i = end
+			continue
+		}
+		out = append(out, line)
+		if trimmed := strings.TrimSuffix(formatted.String(), "\n"); trimmed != "" {
+			out = append(out, strings.Split(trimmed, "\n")...)
+		}
+		out = append(out, lines[end])
+		i = end
+	}
+
+	res := strings.Join(out, "\n")
+	if trailingNewline {
+		res += "\n"
+	}
+	_, err = io.WriteString(w, res)
+	return err
+}
+
+var (
+	markdownMode = flag.Bool("md", false, "treat stdin as a whole Markdown document and reformat every fenced Go code block in place")
+	simplifyAST  = flag.Bool("s", false, "simplify code")
+	rewriteRule  = flag.String("r", "", "rewrite rule (e.g., 'a[b:len(a)] -> a[b:]')")
+)
+
+// rewrite holds the compiled -r rewrite rule, or nil if none was given.
+var rewrite func(fset *token.FileSet, f *ast.File) *ast.File
+
+func initRewrite() error {
+	if *rewriteRule == "" {
+		rewrite = nil
+		return nil
+	}
+	fn, err := parseRewriteRule(*rewriteRule)
+	if err != nil {
+		return fmt.Errorf("parsing -r rule: %v", err)
+	}
+	rewrite = fn
+	return nil
+}
+
 func main() {
-	if err := run(os.Stdin, os.Stdout); err != nil {
+	flag.Parse()
+	if err := initRewrite(); err != nil {
+		log.Fatalln(err)
+	}
+	f := run
+	if *markdownMode {
+		f = runMarkdown
+	}
+	if err := f(os.Stdin, os.Stdout); err != nil {
 		log.Fatalln(err)
 	}
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"flag"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/matttproud/goldentest"
@@ -40,6 +41,14 @@ func Test(t *testing.T) {
 			input:  "testdata/regression.go",
 			output: "testdata/golden/regression.go",
 		},
+		{
+			input:  "testdata/tabindent.go",
+			output: "testdata/golden/tabindent.go",
+		},
+		{
+			input:  "testdata/gomod.txt",
+			output: "testdata/golden/gomod.txt",
+		},
 	} {
 		t.Run(test.input, func(t *testing.T) {
 			f, err := os.Open(test.input)
@@ -62,83 +71,214 @@ func Test(t *testing.T) {
 	}
 }
 
-func TestMinIndent(t *testing.T) {
+func TestRunMarkdown(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "indented fence in a list item",
+			in: "- item:\n" +
+				"  ```go\n" +
+				"  if true {\n" +
+				"  fmt.Println(\"hi\")\n" +
+				"  }\n" +
+				"  ```\n",
+			want: "- item:\n" +
+				"  ```go\n" +
+				"  if true {\n" +
+				"  \tfmt.Println(\"hi\")\n" +
+				"  }\n" +
+				"  ```\n",
+		},
+		{
+			name: "untagged fence treated as Go",
+			in:   "```\nfmt.Println(\"hi\")\n```\n",
+			want: "```\nfmt.Println(\"hi\")\n```\n",
+		},
+		{
+			name: "tilde fence",
+			in:   "~~~go\nfmt.Println( \"hi\" )\n~~~\n",
+			want: "~~~go\nfmt.Println(\"hi\")\n~~~\n",
+		},
+		{
+			name: "other language left untouched",
+			in:   "```python\nprint( 'hi' )\n```\n",
+			want: "```python\nprint( 'hi' )\n```\n",
+		},
+		{
+			name: "malformed Go left untouched",
+			in:   "```go\nfunc ((( invalid\n```\n",
+			want: "```go\nfunc ((( invalid\n```\n",
+		},
+		{
+			name: "go.mod fence",
+			in:   "```go.mod\nmodule example.com/foo\n\ngo   1.21\n```\n",
+			want: "```go.mod\nmodule example.com/foo\n\ngo 1.21\n```\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := runMarkdown(strings.NewReader(test.in), &out); err != nil {
+				t.Fatalf("runMarkdown(...) returned error: %v", err)
+			}
+			if got := out.String(); got != test.want {
+				t.Errorf("runMarkdown(...) = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSimplify(t *testing.T) {
+	*simplifyAST = true
+	t.Cleanup(func() { *simplifyAST = false })
+
+	var out bytes.Buffer
+	if err := run(strings.NewReader("x := s[0:len(s)]\n"), &out); err != nil {
+		t.Fatalf("run(...) returned error: %v", err)
+	}
+	if want, got := "x := s[0:]", out.String(); got != want {
+		t.Errorf("run(...) = %q, want %q", got, want)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	*rewriteRule = "s[0:len(s)] -> s[0:]"
+	t.Cleanup(func() {
+		*rewriteRule = ""
+		rewrite = nil
+	})
+	if err := initRewrite(); err != nil {
+		t.Fatalf("initRewrite() returned error: %v", err)
+	}
+
 	tests := []struct {
 		name string
 		in   string
-		want int
+		want string
+	}{
+		{
+			name: "whole program",
+			in:   "package p\n\nfunc f() { x := s[0:len(s)] }\n",
+			want: "package p\n\nfunc f() { x := s[0:] }",
+		},
+		{
+			// -r must apply to fragments too, not just whole programs: it
+			// operates on the same wrapped *ast.File that -s does.
+			name: "fragment",
+			in:   "func foo() {\nx := s[0:len(s)]\n}\n",
+			want: "func foo() {\n\tx := s[0:]\n}",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := run(strings.NewReader(test.in), &out); err != nil {
+				t.Fatalf("run(...) returned error: %v", err)
+			}
+			if got := out.String(); got != test.want {
+				t.Errorf("run(...) = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMinIndent(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       string
+		want     int
+		wantChar rune
 	}{
 		{
-			name: "empty",
-			in:   "",
-			want: 0,
+			name:     "empty",
+			in:       "",
+			want:     0,
+			wantChar: ' ',
 		},
 		{
-			name: "whitespace_only",
-			in:   "  \n\t \n",
-			want: 2,
+			name:     "whitespace_only",
+			in:       "  \n\t \n",
+			want:     2,
+			wantChar: ' ',
 		},
 		{
-			name: "no_indent",
-			in:   "hello\nworld",
-			want: 0,
+			name:     "no_indent",
+			in:       "hello\nworld",
+			want:     0,
+			wantChar: ' ',
 		},
 		{
-			name: "spaces",
-			in:   "  hello\n  world",
-			want: 2,
+			name:     "spaces",
+			in:       "  hello\n  world",
+			want:     2,
+			wantChar: ' ',
 		},
 		{
-			name: "tabs",
-			in:   "\thello\n\tworld",
-			want: 1,
+			name:     "tabs",
+			in:       "\thello\n\tworld",
+			want:     1,
+			wantChar: '\t',
 		},
 		{
-			name: "mixed_indent_spaces_and_tabs",
-			in:   "  hello\n\tworld",
-			want: 1,
+			name:     "mixed_indent_spaces_and_tabs",
+			in:       "  hello\n\tworld",
+			want:     1,
+			wantChar: ' ',
 		},
 		{
-			name: "varied_indent",
-			in:   "   hello\n world\n  again",
-			want: 1,
+			name:     "varied_indent",
+			in:       "   hello\n world\n  again",
+			want:     1,
+			wantChar: ' ',
 		},
 		{
-			name: "with_empty_line",
-			in:   "  hello\n\n  world",
-			want: 2,
+			name:     "with_empty_line",
+			in:       "  hello\n\n  world",
+			want:     2,
+			wantChar: ' ',
 		},
 		{
-			name: "leading_empty_line",
-			in:   "\n  hello\n  world",
-			want: 2,
+			name:     "leading_empty_line",
+			in:       "\n  hello\n  world",
+			want:     2,
+			wantChar: ' ',
 		},
 		{
-			name: "no_indent_with_empty_line",
-			in:   "hello\n\nworld",
-			want: 0,
+			name:     "no_indent_with_empty_line",
+			in:       "hello\n\nworld",
+			want:     0,
+			wantChar: ' ',
 		},
 		{
-			name: "single_tab",
-			in:   "\t// Hi",
-			want: 1,
+			name:     "single_tab",
+			in:       "\t// Hi",
+			want:     1,
+			wantChar: '\t',
 		},
 		{
-			name: "double_tab",
-			in:   "\t\t // Hi",
-			want: 3,
+			name:     "double_tab",
+			in:       "\t\t // Hi",
+			want:     3,
+			wantChar: '\t',
 		},
 		{
-			name: "space_and_tab",
-			in:   " \t // Hi",
-			want: 3,
+			name:     "space_and_tab",
+			in:       " \t // Hi",
+			want:     3,
+			wantChar: ' ',
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			want := test.want
-			if got := minIndent(test.in); got != want {
-				t.Errorf("minIndent() = %v, want %v", got, want)
+			got := minIndent(test.in)
+			if got.count != test.want {
+				t.Errorf("minIndent().count = %v, want %v", got.count, test.want)
+			}
+			if got.char != test.wantChar {
+				t.Errorf("minIndent().char = %q, want %q", got.char, test.wantChar)
 			}
 		})
 	}
@@ -0,0 +1 @@
+fmt.Println("hi")
\ No newline at end of file
@@ -0,0 +1,3 @@
+  if true {
+  	fmt.Println("indented")
+  }
\ No newline at end of file
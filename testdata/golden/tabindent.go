@@ -0,0 +1,3 @@
+		if true {
+			fmt.Println("tabs")
+		}
\ No newline at end of file
@@ -0,0 +1,3 @@
+if err != nil {
+	return err
+}
\ No newline at end of file
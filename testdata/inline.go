@@ -0,0 +1,7 @@
+type Point struct {
+X,Y int
+}
+
+func (p Point) String() string {
+return fmt.Sprintf("(%d,%d)", p.X, p.Y)
+}
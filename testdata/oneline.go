@@ -0,0 +1 @@
+fmt.Println("hi")
@@ -0,0 +1,3 @@
+		if true {
+		fmt.Println("tabs")
+		}
@@ -0,0 +1,5 @@
+if err != nil {
+return err
+}
+
+